@@ -0,0 +1,537 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+
+	"github.com/grafana/mimir/pkg/storage/bucket"
+	mimir_tsdb "github.com/grafana/mimir/pkg/storage/tsdb"
+)
+
+// knownMimirExternalLabels are the Thanos external labels that mimir itself attaches to blocks.
+// Any other label found on a block's meta.json is considered stale and is removed.
+var knownMimirExternalLabels = map[string]struct{}{
+	mimir_tsdb.TenantIDExternalLabel:         {},
+	mimir_tsdb.CompactorShardIDExternalLabel: {},
+	mimir_tsdb.IngesterIDExternalLabel:       {},
+}
+
+func main() {
+	var (
+		bucketCfg       bucket.Config
+		tenant          string
+		dryRun          bool
+		concurrencyFlag int
+		minTime         int64
+		maxTime         int64
+		idAllowlist     string
+		idDenylist      string
+		reportFile      string
+		auditLogFile    string
+	)
+
+	flag.StringVar(&tenant, "tenant", "", "Tenant ID to set on every block's meta.json.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Don't upload any changes, only report what would change.")
+	flag.IntVar(&concurrencyFlag, "concurrency", 16, "Number of blocks to convert concurrently.")
+	flag.Int64Var(&minTime, "min-time", 0, "Only process blocks whose MaxTime is at or after this unix millisecond timestamp. 0 means no lower bound.")
+	flag.Int64Var(&maxTime, "max-time", 0, "Only process blocks whose MinTime is at or before this unix millisecond timestamp. 0 means no upper bound.")
+	flag.StringVar(&idAllowlist, "id-allowlist", "", "Comma-separated list of block ULIDs (or a path to a file containing one ULID per line) to process. All other blocks are skipped. Mutually exclusive with -id-denylist.")
+	flag.StringVar(&idDenylist, "id-denylist", "", "Comma-separated list of block ULIDs (or a path to a file containing one ULID per line) to skip.")
+	flag.StringVar(&reportFile, "report-file", "", "If set, write a JSON report of per-block decisions to this path.")
+	flag.StringVar(&auditLogFile, "audit-log", "", "If set, append a machine-parseable JSON audit record per block to this path.")
+	bucketCfg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	if tenant == "" {
+		fmt.Fprintln(os.Stderr, "-tenant flag is required")
+		os.Exit(1)
+	}
+
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
+	ctx := context.Background()
+
+	bkt, err := bucket.NewClient(ctx, bucketCfg, "metaconvert", logger, nil)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to create bucket client", "err", err)
+		os.Exit(1)
+	}
+
+	ids, err := parseIDFilter(idAllowlist, idDenylist)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to parse id-allowlist/id-denylist", "err", err)
+		os.Exit(1)
+	}
+
+	var auditLog io.Writer
+	if auditLogFile != "" {
+		f, err := os.OpenFile(auditLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to open audit log", "err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		auditLog = f
+	}
+
+	opts := conversionOptions{
+		concurrency: concurrencyFlag,
+		ids:         ids,
+		minTime:     minTime,
+		maxTime:     maxTime,
+		registerer:  prometheus.DefaultRegisterer,
+		auditLog:    auditLog,
+	}
+
+	report, err := convertTenantBlocks(ctx, bkt, tenant, dryRun, logger, opts)
+	if reportFile != "" {
+		if werr := writeReportFile(reportFile, report); werr != nil {
+			level.Error(logger).Log("msg", "failed to write report file", "err", werr)
+		}
+	}
+	if err != nil {
+		level.Error(logger).Log("msg", "conversion failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// idFilter decides whether a block should be processed, based on an optional allowlist or
+// denylist of block ULIDs. A nil idFilter processes every block.
+type idFilter struct {
+	allow map[ulid.ULID]struct{}
+	deny  map[ulid.ULID]struct{}
+}
+
+func (f *idFilter) isAllowed(id ulid.ULID) bool {
+	if f == nil {
+		return true
+	}
+	if f.allow != nil {
+		_, ok := f.allow[id]
+		return ok
+	}
+	if f.deny != nil {
+		_, ok := f.deny[id]
+		return !ok
+	}
+	return true
+}
+
+func parseIDFilter(allowlist, denylist string) (*idFilter, error) {
+	if allowlist != "" && denylist != "" {
+		return nil, errors.New("-id-allowlist and -id-denylist are mutually exclusive")
+	}
+	if allowlist == "" && denylist == "" {
+		return nil, nil
+	}
+
+	if allowlist != "" {
+		ids, err := parseIDList(allowlist)
+		if err != nil {
+			return nil, errors.Wrap(err, "-id-allowlist")
+		}
+		return &idFilter{allow: ids}, nil
+	}
+
+	ids, err := parseIDList(denylist)
+	if err != nil {
+		return nil, errors.Wrap(err, "-id-denylist")
+	}
+	return &idFilter{deny: ids}, nil
+}
+
+// parseIDList accepts either a comma-separated list of ULIDs, or a path to a file containing one
+// ULID per line (blank lines are ignored).
+func parseIDList(arg string) (map[ulid.ULID]struct{}, error) {
+	var entries []string
+
+	if strings.Contains(arg, ",") {
+		entries = strings.Split(arg, ",")
+	} else if _, err := ulid.Parse(arg); err == nil {
+		entries = []string{arg}
+	} else {
+		f, err := os.Open(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s as a file of block IDs", arg)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			entries = append(entries, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	ids := make(map[ulid.ULID]struct{}, len(entries))
+	for _, e := range entries {
+		id, err := ulid.Parse(strings.TrimSpace(e))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid block ID %q", e)
+		}
+		ids[id] = struct{}{}
+	}
+	return ids, nil
+}
+
+// conversionOptions bounds and filters a convertTenantBlocks run.
+type conversionOptions struct {
+	// concurrency is the number of blocks converted at once. Values <= 1 mean sequential.
+	concurrency int
+	// ids optionally restricts the run to an allowlist or denylist of block ULIDs.
+	ids *idFilter
+	// minTime and maxTime, when non-zero, restrict the run to blocks overlapping that window.
+	minTime, maxTime int64
+	// registerer, if set, receives the cortex_tenant_convert_blocks_* metrics for this run.
+	registerer prometheus.Registerer
+	// auditLog, if set, receives one JSON audit record per block considered.
+	auditLog io.Writer
+}
+
+// conversionMetrics holds the cortex_tenant_convert_blocks_* metrics for a single
+// convertTenantBlocks run. Passing a nil conversionOptions.registerer still creates the
+// collectors, it just doesn't register them with anything.
+type conversionMetrics struct {
+	scanned  prometheus.Counter
+	changed  *prometheus.CounterVec
+	failed   *prometheus.CounterVec
+	duration prometheus.Histogram
+	inFlight prometheus.Gauge
+}
+
+func newConversionMetrics(reg prometheus.Registerer) *conversionMetrics {
+	return &conversionMetrics{
+		scanned: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_tenant_convert_blocks_scanned_total",
+			Help: "Number of blocks scanned by the tenant block conversion tool.",
+		}),
+		changed: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_tenant_convert_blocks_changed_total",
+			Help: "Number of blocks whose meta.json needed a change, by reason.",
+		}, []string{"reason"}),
+		failed: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_tenant_convert_blocks_failed_total",
+			Help: "Number of blocks that failed to convert, by stage.",
+		}, []string{"stage"}),
+		duration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "cortex_tenant_convert_blocks_duration_seconds",
+			Help:    "Time taken to process a single block, from download through upload.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		inFlight: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_tenant_convert_blocks_in_flight",
+			Help: "Number of blocks currently being converted.",
+		}),
+	}
+}
+
+func (m *conversionMetrics) incFailed(stage string) {
+	m.failed.WithLabelValues(stage).Inc()
+}
+
+func (m *conversionMetrics) incChanged(reason string) {
+	m.changed.WithLabelValues(reason).Inc()
+}
+
+// auditRecord is a single machine-parseable line written to -audit-log for every block
+// considered, independent of the human-readable logs.
+type auditRecord struct {
+	Block         string            `json:"block"`
+	Tenant        string            `json:"tenant"`
+	Decision      string            `json:"decision"` // "changed", "unchanged" or "skipped"
+	Error         string            `json:"error,omitempty"`
+	OldLabels     map[string]string `json:"old_labels,omitempty"`
+	NewLabels     map[string]string `json:"new_labels,omitempty"`
+	RemovedLabels []string          `json:"removed_labels,omitempty"`
+	DryRun        bool              `json:"dry_run"`
+	Uploaded      bool              `json:"uploaded"`
+}
+
+func writeAuditRecord(w io.Writer, rec auditRecord) error {
+	if w == nil {
+		return nil
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "encode audit record")
+	}
+	buf = append(buf, '\n')
+	_, err = w.Write(buf)
+	return err
+}
+
+func (o conversionOptions) inTimeRange(meta metadata.Meta) bool {
+	if o.minTime != 0 && meta.MaxTime < o.minTime {
+		return false
+	}
+	if o.maxTime != 0 && meta.MinTime > o.maxTime {
+		return false
+	}
+	return true
+}
+
+// blockReport records the decision made for a single block, for inclusion in the JSON report.
+type blockReport struct {
+	Block     string            `json:"block"`
+	Decision  string            `json:"decision"` // "changed", "unchanged" or "skipped"
+	OldLabels map[string]string `json:"old_labels,omitempty"`
+	NewLabels map[string]string `json:"new_labels,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// conversionReport is the top-level JSON document written to -report-file.
+type conversionReport struct {
+	Tenant string        `json:"tenant"`
+	DryRun bool          `json:"dry_run"`
+	Blocks []blockReport `json:"blocks"`
+}
+
+func writeReportFile(path string, report *conversionReport) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// convertTenantBlocks walks every block in bkt and rewrites its meta.json so that the block's
+// tenant label matches tenant and any label mimir doesn't recognise is removed. It returns a
+// report describing the decision made for every block it considered, along with an error if
+// listing the bucket failed or, outside of dry-run mode, the first meta.json upload that failed
+// (which aborts the rest of the run). A block whose meta.json could not be downloaded is recorded
+// in the report as skipped and does not abort the run.
+func convertTenantBlocks(ctx context.Context, bkt objstore.Bucket, tenant string, dryRun bool, logger log.Logger, opts conversionOptions) (*conversionReport, error) {
+	logger = log.With(logger, "tenant", tenant)
+	report := &conversionReport{Tenant: tenant, DryRun: dryRun}
+	metrics := newConversionMetrics(opts.registerer)
+	auditLog := newSyncWriter(opts.auditLog)
+
+	var ids []ulid.ULID
+	err := bkt.Iter(ctx, "", func(name string) error {
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		if !opts.ids.isAllowed(id) {
+			return nil
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return report, errors.Wrap(err, "failed to list blocks")
+	}
+
+	reports := make([]blockReport, len(ids))
+
+	jobConcurrency := opts.concurrency
+	if jobConcurrency <= 0 {
+		jobConcurrency = 1
+	}
+
+	err = concurrency.ForEachJob(ctx, len(ids), jobConcurrency, func(ctx context.Context, idx int) error {
+		id := ids[idx]
+
+		r, uploadErr := convertBlock(ctx, bkt, id, tenant, dryRun, logger, opts, metrics, auditLog)
+		reports[idx] = r
+
+		// Only a failed upload aborts the rest of the run; a block we failed to download or
+		// decode is recorded as skipped in the report and the run continues.
+		if uploadErr != nil && !dryRun {
+			return uploadErr
+		}
+		return nil
+	})
+
+	report.Blocks = reports
+	return report, err
+}
+
+// convertBlock downloads a single block's meta.json, decides whether it needs a tenant label or
+// label cleanup, and (outside of dry-run mode) uploads the result back. The returned error is
+// only non-nil when the upload itself failed; a download failure is recorded in the report but
+// does not abort the rest of the run.
+func convertBlock(ctx context.Context, bkt objstore.Bucket, id ulid.ULID, tenant string, dryRun bool, logger log.Logger, opts conversionOptions, metrics *conversionMetrics, auditLog io.Writer) (blockReport, error) {
+	metrics.scanned.Inc()
+	metrics.inFlight.Inc()
+	defer metrics.inFlight.Dec()
+
+	start := time.Now()
+	defer func() { metrics.duration.Observe(time.Since(start).Seconds()) }()
+
+	r := blockReport{Block: id.String()}
+
+	var removedLabels []string
+	uploaded := false
+	// Cover every block this func considers, not just ones it rewrites, so the audit log can
+	// also answer "was this block scanned and left alone, or why was it skipped" - the fields
+	// below read r, removedLabels and uploaded as of whenever this func returns.
+	defer func() {
+		if auditErr := writeAuditRecord(auditLog, auditRecord{
+			Block:         id.String(),
+			Tenant:        tenant,
+			Decision:      r.Decision,
+			Error:         r.Error,
+			OldLabels:     r.OldLabels,
+			NewLabels:     r.NewLabels,
+			RemovedLabels: removedLabels,
+			DryRun:        dryRun,
+			Uploaded:      uploaded,
+		}); auditErr != nil {
+			level.Error(logger).Log("msg", "failed to write audit record", "block", id.String(), "err", auditErr)
+		}
+	}()
+
+	meta, err := block.DownloadMeta(ctx, logger, bkt, id)
+	if err != nil {
+		level.Warn(logger).Log("msg", "failed to download meta.json", "block", id.String(), "err", err)
+		metrics.incFailed("download")
+		r.Decision = "skipped"
+		r.Error = err.Error()
+		return r, nil
+	}
+
+	if !opts.inTimeRange(meta) {
+		level.Info(logger).Log("msg", "skipping block outside of requested time range", "block", id.String())
+		r.Decision = "skipped"
+		return r, nil
+	}
+
+	r.OldLabels = copyLabels(meta.Thanos.Labels)
+
+	var changed bool
+	changed, removedLabels = updateBlockLabels(&meta, tenant, logger, metrics)
+	if !changed {
+		level.Info(logger).Log("msg", "no changes required", "block", id.String())
+		r.Decision = "unchanged"
+		return r, nil
+	}
+
+	r.Decision = "changed"
+	r.NewLabels = copyLabels(meta.Thanos.Labels)
+
+	if dryRun {
+		level.Warn(logger).Log("msg", "changes required, not uploading back due to dry run", "block", id.String())
+		return r, nil
+	}
+
+	level.Info(logger).Log("msg", "changes required, uploading meta.json file", "block", id.String())
+
+	if err := uploadMetadata(ctx, bkt, meta, path.Join(id.String(), metadata.MetaFilename), metrics); err != nil {
+		r.Error = err.Error()
+		return r, errors.Wrapf(err, "failed to upload meta.json for block %s", id)
+	}
+
+	uploaded = true
+	level.Info(logger).Log("msg", "meta.json file uploaded successfully", "block", id.String())
+	return r, nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
+
+// updateBlockLabels rewrites meta's external labels so that the tenant label matches tenant and
+// any label mimir doesn't recognise is removed. It returns whether meta was modified, and the
+// keys of any labels that were removed.
+func updateBlockLabels(meta *metadata.Meta, tenant string, logger log.Logger, metrics *conversionMetrics) (bool, []string) {
+	changed := false
+	var removed []string
+
+	if meta.Thanos.Labels == nil {
+		meta.Thanos.Labels = map[string]string{}
+	}
+
+	if old := meta.Thanos.Labels[mimir_tsdb.TenantIDExternalLabel]; old != tenant {
+		level.Warn(logger).Log("msg", "updating tenant label", "block", meta.ULID.String(), "old_value", old, "new_value", tenant)
+		meta.Thanos.Labels[mimir_tsdb.TenantIDExternalLabel] = tenant
+		metrics.incChanged("tenant_label")
+		changed = true
+	}
+
+	for k, v := range meta.Thanos.Labels {
+		if _, known := knownMimirExternalLabels[k]; known {
+			continue
+		}
+		level.Warn(logger).Log("msg", "removing unknown label", "block", meta.ULID.String(), "label", k, "value", v)
+		delete(meta.Thanos.Labels, k)
+		metrics.incChanged("unknown_label_removed")
+		removed = append(removed, k)
+		changed = true
+	}
+
+	return changed, removed
+}
+
+// uploadMetadata marshals meta as JSON and uploads it to path in bkt.
+func uploadMetadata(ctx context.Context, bkt objstore.Bucket, meta metadata.Meta, path string, metrics *conversionMetrics) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&meta); err != nil {
+		return errors.Wrap(err, "encode meta.json")
+	}
+	if err := bkt.Upload(ctx, path, &buf); err != nil {
+		metrics.incFailed("upload")
+		return err
+	}
+	return nil
+}
+
+// syncWriter serializes concurrent writes to w so that audit records from parallel block
+// conversions don't interleave. A nil w yields a nil syncWriter, which writeAuditRecord treats as
+// "don't write anything".
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newSyncWriter(w io.Writer) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return &syncWriter{w: w}
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
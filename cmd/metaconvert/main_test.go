@@ -3,7 +3,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"path"
 	"strings"
@@ -12,6 +14,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/grafana/dskit/concurrency"
 	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -101,14 +104,15 @@ func TestConvertTenantBlocks(t *testing.T) {
 	}
 
 	for b, m := range inputMetas {
-		require.NoError(t, uploadMetadata(ctx, bkt, m, path.Join(b.String(), metadata.MetaFilename)))
+		require.NoError(t, uploadMetadata(ctx, bkt, m, path.Join(b.String(), metadata.MetaFilename), nil))
 	}
 
 	logs := &concurrency.SyncBuffer{}
 	logger := log.NewLogfmtLogger(logs)
 
 	// Run conversion
-	assert.NoError(t, convertTenantBlocks(ctx, bkt, tenant, false, logger))
+	_, err = convertTenantBlocks(ctx, bkt, tenant, false, logger, conversionOptions{concurrency: 1})
+	assert.NoError(t, err)
 
 	expected := map[ulid.ULID]metadata.Meta{
 		blockWithNoLabelsButManyOtherFields: {
@@ -276,14 +280,15 @@ func TestConvertTenantBlocksDryMode(t *testing.T) {
 	}
 
 	for b, m := range inputMetas {
-		require.NoError(t, uploadMetadata(ctx, bkt, m, path.Join(b.String(), metadata.MetaFilename)))
+		require.NoError(t, uploadMetadata(ctx, bkt, m, path.Join(b.String(), metadata.MetaFilename), nil))
 	}
 
 	logs := &concurrency.SyncBuffer{}
 	logger := log.NewLogfmtLogger(logs)
 
 	// Run conversion
-	assert.NoError(t, convertTenantBlocks(ctx, bkt, tenant, true, logger))
+	_, err = convertTenantBlocks(ctx, bkt, tenant, true, logger, conversionOptions{concurrency: 1})
+	assert.NoError(t, err)
 
 	for b, m := range inputMetas {
 		meta, err := block.DownloadMeta(ctx, logger, bkt, b)
@@ -304,3 +309,138 @@ func TestConvertTenantBlocksDryMode(t *testing.T) {
 		`level=info tenant=target_tenant msg="no changes required" block=00000000040000000000000000`,
 	}, strings.Split(strings.TrimSpace(logs.String()), "\n"))
 }
+
+func TestConvertTenantBlocksWithFilters(t *testing.T) {
+	dir := t.TempDir()
+	bkt, err := filesystem.NewBucketClient(filesystem.Config{Directory: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	const tenant = "target_tenant"
+
+	blockInRange := ulid.MustNew(1, nil)
+	blockOutOfRange := ulid.MustNew(2, nil)
+	blockDenied := ulid.MustNew(3, nil)
+
+	inputMetas := map[ulid.ULID]metadata.Meta{
+		blockInRange: {
+			BlockMeta: tsdb.BlockMeta{ULID: blockInRange, MinTime: 100, MaxTime: 200},
+		},
+		blockOutOfRange: {
+			BlockMeta: tsdb.BlockMeta{ULID: blockOutOfRange, MinTime: 1000, MaxTime: 2000},
+		},
+		blockDenied: {
+			BlockMeta: tsdb.BlockMeta{ULID: blockDenied, MinTime: 100, MaxTime: 200},
+		},
+	}
+
+	for b, m := range inputMetas {
+		require.NoError(t, uploadMetadata(ctx, bkt, m, path.Join(b.String(), metadata.MetaFilename), nil))
+	}
+
+	report, err := convertTenantBlocks(ctx, bkt, tenant, false, logger, conversionOptions{
+		concurrency: 4,
+		ids:         &idFilter{deny: map[ulid.ULID]struct{}{blockDenied: {}}},
+		minTime:     0,
+		maxTime:     500,
+	})
+	require.NoError(t, err)
+
+	decisions := map[string]string{}
+	for _, b := range report.Blocks {
+		decisions[b.Block] = b.Decision
+	}
+
+	assert.Equal(t, "changed", decisions[blockInRange.String()])
+	assert.Equal(t, "skipped", decisions[blockOutOfRange.String()])
+	assert.Len(t, decisions, 2, "denied block should not have been visited at all")
+
+	meta, err := block.DownloadMeta(ctx, logger, bkt, blockDenied)
+	require.NoError(t, err)
+	assert.Empty(t, meta.Thanos.Labels[mimir_tsdb.TenantIDExternalLabel], "denied block must not be touched")
+}
+
+func TestConvertTenantBlocksMetricsAndAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	bkt, err := filesystem.NewBucketClient(filesystem.Config{Directory: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	const tenant = "target_tenant"
+
+	changedBlock := ulid.MustNew(1, nil)
+	unchangedBlock := ulid.MustNew(2, nil)
+
+	inputMetas := map[ulid.ULID]metadata.Meta{
+		changedBlock: {
+			BlockMeta: tsdb.BlockMeta{ULID: changedBlock},
+			Thanos: metadata.Thanos{
+				Labels: map[string]string{"stale": "label"},
+			},
+		},
+		unchangedBlock: {
+			BlockMeta: tsdb.BlockMeta{ULID: unchangedBlock},
+			Thanos: metadata.Thanos{
+				Labels: map[string]string{mimir_tsdb.TenantIDExternalLabel: tenant},
+			},
+		},
+	}
+
+	for b, m := range inputMetas {
+		require.NoError(t, uploadMetadata(ctx, bkt, m, path.Join(b.String(), metadata.MetaFilename), nil))
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	auditLog := &bytes.Buffer{}
+
+	_, err = convertTenantBlocks(ctx, bkt, tenant, false, logger, conversionOptions{
+		concurrency: 2,
+		registerer:  reg,
+		auditLog:    auditLog,
+	})
+	require.NoError(t, err)
+
+	metricNames := []string{
+		"cortex_tenant_convert_blocks_scanned_total",
+		"cortex_tenant_convert_blocks_changed_total",
+		"cortex_tenant_convert_blocks_duration_seconds",
+		"cortex_tenant_convert_blocks_in_flight",
+	}
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	found := map[string]bool{}
+	for _, mf := range mfs {
+		found[mf.GetName()] = true
+	}
+	for _, name := range metricNames {
+		assert.True(t, found[name], "expected metric %s to be registered", name)
+	}
+
+	auditLines := strings.Split(strings.TrimSpace(auditLog.String()), "\n")
+	require.Len(t, auditLines, 2, "every block considered should produce an audit record")
+
+	recs := map[string]auditRecord{}
+	for _, line := range auditLines {
+		var rec auditRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		recs[rec.Block] = rec
+	}
+
+	changedRec := recs[changedBlock.String()]
+	assert.Equal(t, tenant, changedRec.Tenant)
+	assert.Equal(t, "changed", changedRec.Decision)
+	assert.Equal(t, []string{"stale"}, changedRec.RemovedLabels)
+	assert.True(t, changedRec.Uploaded)
+	assert.False(t, changedRec.DryRun)
+
+	unchangedRec := recs[unchangedBlock.String()]
+	assert.Equal(t, tenant, unchangedRec.Tenant)
+	assert.Equal(t, "unchanged", unchangedRec.Decision)
+	assert.Empty(t, unchangedRec.RemovedLabels)
+	assert.False(t, unchangedRec.Uploaded)
+	assert.False(t, unchangedRec.DryRun)
+}
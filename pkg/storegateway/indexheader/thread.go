@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: AGPL-3.0-only
+// Provenance-includes-location: https://github.com/cpg1111/threadpool-go/blob/master/thread.go
+// Provenance-includes-license: MIT
+// Provenance-includes-copyright: Christian Grabowski
+
+package indexheader
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrTaskPanic is returned by Call when the submitted function panicked instead of returning
+// normally. The original panic value and a stack trace are included in the error message.
+var ErrTaskPanic = errors.New("panic while running task")
+
+// result carries the outcome of a single call executed by an OSThread back to its caller.
+type result struct {
+	val interface{}
+	err error
+}
+
+// OSThread runs functions submitted via Call on a single, dedicated OS thread. This allows
+// callers to perform operations that depend on OS thread-local state (for example, mmap page
+// faults that should not pile up behind Go's scheduler) without being migrated to another OS
+// thread partway through.
+type OSThread struct {
+	// stopping is shared with (and closed by) the owning Threadpool when it is shutting down.
+	stopping chan struct{}
+	// panics, if set, is incremented whenever a call panics instead of returning normally.
+	panics *prometheus.CounterVec
+
+	// calls is used to hand a function to the dedicated thread. It is buffered with a capacity
+	// of one so that a caller can always hand off work, even if the thread hasn't started yet or
+	// has already stopped; the result (or lack of one) is what tells the caller whether the work
+	// actually ran.
+	calls chan func() (interface{}, error)
+	// res carries the result of the most recently executed call back to the caller.
+	res chan result
+	// done is closed once the thread's loop has returned, so that Join (and the owning
+	// Threadpool's supervisor) can detect it.
+	done chan struct{}
+}
+
+// NewOSThread creates an OSThread that stops running calls once the given stopping channel is
+// closed. The thread does not start running until Start is called. panics may be nil, in which
+// case panicking calls are still recovered but not counted.
+func NewOSThread(stopping chan struct{}, panics *prometheus.CounterVec) *OSThread {
+	return &OSThread{
+		stopping: stopping,
+		panics:   panics,
+		calls:    make(chan func() (interface{}, error), 1),
+		res:      make(chan result),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins running the thread's loop on a dedicated OS thread.
+func (t *OSThread) Start() {
+	go t.loop()
+}
+
+func (t *OSThread) loop() {
+	defer close(t.done)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for {
+		select {
+		case <-t.stopping:
+			return
+		case fn := <-t.calls:
+			val, err := t.runSafely(fn)
+
+			select {
+			case t.res <- result{val: val, err: err}:
+			case <-t.stopping:
+				return
+			}
+		}
+	}
+}
+
+// runSafely runs fn, converting a panic into an ErrTaskPanic error rather than letting it tear
+// down the thread's goroutine (which would shrink the pool until a replacement was started).
+func (t *OSThread) runSafely(fn func() (interface{}, error)) (val interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if t.panics != nil {
+				t.panics.WithLabelValues("executing").Inc()
+			}
+			val = nil
+			err = fmt.Errorf("%w: %v\n%s", ErrTaskPanic, r, debug.Stack())
+		}
+	}()
+
+	return fn()
+}
+
+// Call runs fn on this thread's dedicated OS thread and returns its result. If the thread has
+// stopped (or is stopping), Call returns ErrPoolStopped instead of running fn. If fn panics, Call
+// returns an error wrapping ErrTaskPanic instead of propagating the panic.
+func (t *OSThread) Call(fn func() (interface{}, error)) (interface{}, error) {
+	select {
+	case t.calls <- fn:
+	case <-t.stopping:
+		return nil, ErrPoolStopped
+	}
+
+	select {
+	case r, ok := <-t.res:
+		if !ok {
+			return nil, ErrPoolStopped
+		}
+		return r.val, r.err
+	case <-t.stopping:
+		return nil, ErrPoolStopped
+	}
+}
+
+// Join blocks until the thread's loop has returned. The thread is stopped by closing the
+// stopping channel passed to NewOSThread; Join does not do this itself.
+func (t *OSThread) Join() {
+	<-t.done
+}
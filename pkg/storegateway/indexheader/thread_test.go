@@ -5,6 +5,8 @@ package indexheader
 import (
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/grafana/mimir/pkg/util/test"
@@ -15,7 +17,7 @@ func TestOSThread_Call(t *testing.T) {
 		test.VerifyNoLeak(t)
 
 		stopping := make(chan struct{})
-		thread := NewOSThread(stopping)
+		thread := NewOSThread(stopping, nil)
 
 		// Don't start the thread but close the results channel. This ensures that we're testing
 		// the case where the pool isn't shutdown yet, but we return a zero value to the caller.
@@ -32,7 +34,7 @@ func TestOSThread_Call(t *testing.T) {
 		test.VerifyNoLeak(t)
 
 		stopping := make(chan struct{})
-		thread := NewOSThread(stopping)
+		thread := NewOSThread(stopping, nil)
 		t.Cleanup(func() {
 			close(stopping)
 			thread.Join()
@@ -51,7 +53,7 @@ func TestOSThread_Call(t *testing.T) {
 		test.VerifyNoLeak(t)
 
 		stopping := make(chan struct{})
-		thread := NewOSThread(stopping)
+		thread := NewOSThread(stopping, nil)
 		thread.Start()
 		close(stopping)
 		thread.Join()
@@ -63,4 +65,50 @@ func TestOSThread_Call(t *testing.T) {
 		assert.Nil(t, res)
 		assert.ErrorIs(t, err, ErrPoolStopped)
 	})
+
+	t.Run("panicking call is recovered and the thread stays usable", func(t *testing.T) {
+		test.VerifyNoLeak(t)
+
+		stopping := make(chan struct{})
+		thread := NewOSThread(stopping, nil)
+		t.Cleanup(func() {
+			close(stopping)
+			thread.Join()
+		})
+
+		thread.Start()
+
+		res, err := thread.Call(func() (interface{}, error) {
+			panic("boom")
+		})
+		assert.Nil(t, res)
+		assert.ErrorIs(t, err, ErrTaskPanic)
+		assert.Contains(t, err.Error(), "boom")
+
+		// The same OS thread must still be able to run calls after recovering from a panic.
+		res, err = thread.Call(func() (interface{}, error) {
+			return 42, nil
+		})
+		assert.Equal(t, 42, res.(int))
+		assert.NoError(t, err)
+	})
+
+	t.Run("panics are counted", func(t *testing.T) {
+		test.VerifyNoLeak(t)
+
+		stopping := make(chan struct{})
+		panics := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_panics_total"}, []string{"stage"})
+		thread := NewOSThread(stopping, panics)
+		t.Cleanup(func() {
+			close(stopping)
+			thread.Join()
+		})
+
+		thread.Start()
+		_, _ = thread.Call(func() (interface{}, error) {
+			panic("boom")
+		})
+
+		assert.Equal(t, float64(1), testutil.ToFloat64(panics.WithLabelValues("executing")))
+	})
 }
@@ -6,7 +6,10 @@
 package indexheader
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,24 +17,89 @@ import (
 )
 
 const (
-	labelWaiting  = "waiting"
-	labelComplete = "complete"
+	labelWaiting   = "waiting"
+	labelExecuting = "executing"
 )
 
 var ErrPoolStopped = errors.New("thread pool has been stopped")
 
+// ErrPoolOverloaded is returned by CallWithOptions when a call's MaxQueueDepth or MaxWait option
+// is exceeded, so that callers can shed load instead of blocking indefinitely.
+var ErrPoolOverloaded = errors.New("thread pool is overloaded")
+
+// Priority determines how a call is scheduled relative to others waiting for a thread: whenever
+// a thread becomes free, a waiting PriorityInteractive call is always handed it ahead of any
+// waiting PriorityBackground call.
+type Priority int
+
+const (
+	// PriorityBackground is the zero value so that a CallOptions{} literal which forgets to set
+	// Priority fails safe into the lower-priority, slower-scheduled class instead of silently
+	// jumping ahead of real interactive work.
+	PriorityBackground Priority = iota
+	PriorityInteractive
+
+	numPriorities = iota
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return "unknown"
+	}
+}
+
+// CallOptions configures how CallWithOptions admits a call into the pool.
+type CallOptions struct {
+	// Priority determines scheduling order among calls waiting for a thread. See Priority.
+	Priority Priority
+	// MaxQueueDepth caps how many calls of this Priority may be waiting for a thread at the same
+	// time. If admitting this call would exceed it, CallWithOptions returns ErrPoolOverloaded
+	// immediately instead of joining the queue. Zero means unbounded.
+	MaxQueueDepth int
+	// MaxWait caps how long this call will wait for a thread to become available. Once it elapses,
+	// CallWithOptions returns ErrPoolOverloaded. Zero means wait indefinitely, subject only to ctx.
+	MaxWait time.Duration
+}
+
+// threadRequest is a single call's place in line for a thread. respond is buffered so that the
+// dispatcher can hand over an idx without blocking on a caller that has since given up.
+type threadRequest struct {
+	respond chan int
+}
+
 type Threadpool struct {
-	// pool is used for callers to acquire and return threads, blocking when they are all in use.
-	pool chan *OSThread
-	// threads is used to perform operations on all threads at once (such as stopping and shutting down).
+	// pool hands out indices into threads to the dispatcher, which in turn hands them to waiting
+	// callers. Indices rather than *OSThread values are passed around so that a dead thread can be
+	// replaced in-place (see superviseWorker) without having to find and swap out a stale value
+	// already sitting in the channel buffer.
+	pool chan int
+	// mu guards threads against concurrent reads (by Call) and writes (by superviseWorker).
+	mu      sync.RWMutex
 	threads []*OSThread
+
+	// interactiveReq and backgroundReq are where CallWithOptions submits a threadRequest while it
+	// waits for a thread. The dispatcher drains interactiveReq first, so an interactive call
+	// waiting behind a backlog of background calls still jumps the queue.
+	interactiveReq chan *threadRequest
+	backgroundReq  chan *threadRequest
+	queueDepths    [numPriorities]int64
+
 	// stopping is closed when calling code wants the threadpool to shut down.
 	stopping chan struct{}
 	// stopped is closed once all threads have stopped running.
 	stopped chan struct{}
 
-	timing *prometheus.HistogramVec
-	tasks  prometheus.Gauge
+	timing     *prometheus.HistogramVec
+	tasks      prometheus.Gauge
+	cancelled  *prometheus.CounterVec
+	panics     *prometheus.CounterVec
+	queueDepth *prometheus.GaugeVec
+	rejected   *prometheus.CounterVec
 }
 
 func NewThreadPool(num int, reg prometheus.Registerer) *Threadpool {
@@ -40,23 +108,42 @@ func NewThreadPool(num int, reg prometheus.Registerer) *Threadpool {
 	}
 
 	tp := &Threadpool{
-		pool:     make(chan *OSThread, num),
+		pool:     make(chan int, num),
 		threads:  make([]*OSThread, num),
 		stopping: make(chan struct{}),
 		stopped:  make(chan struct{}),
 
+		interactiveReq: make(chan *threadRequest),
+		backgroundReq:  make(chan *threadRequest),
+
 		timing: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
 			Name: "cortex_bucket_store_indexheader_thread_pool_seconds",
 			Help: "Amount of time spent performing index header operations on a dedicated thread",
-		}, []string{"stage"}),
+		}, []string{"stage", "priority"}),
 		tasks: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 			Name: "cortex_bucket_store_indexheader_thread_pool_tasks",
 			Help: "Number of index header operations currently executing",
 		}),
+		cancelled: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_store_indexheader_thread_pool_cancelled_total",
+			Help: "Number of index header operations that were cancelled before or during execution",
+		}, []string{"reason"}),
+		panics: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_store_indexheader_thread_pool_panics_total",
+			Help: "Number of index header operations that panicked, by stage",
+		}, []string{"stage"}),
+		queueDepth: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "cortex_bucket_store_indexheader_thread_pool_queue_depth",
+			Help: "Number of calls currently waiting for a thread, by priority",
+		}, []string{"priority"}),
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "cortex_bucket_store_indexheader_thread_pool_rejected_total",
+			Help: "Number of calls refused admission to the pool instead of waiting for a thread, by reason",
+		}, []string{"reason"}),
 	}
 
 	for i := 0; i < num; i++ {
-		t := NewOSThread()
+		t := NewOSThread(tp.stopping, tp.panics)
 		t.Start()
 
 		// Use a slice so that we keep a reference to all threads that are running
@@ -64,31 +151,108 @@ func NewThreadPool(num int, reg prometheus.Registerer) *Threadpool {
 		// so that we can limit the number of threads in use and block when there
 		// are none available.
 		tp.threads[i] = t
-		tp.pool <- t
+		tp.pool <- i
 	}
 
+	// The dispatcher matches idle threads with waiting calls and must run regardless of whether
+	// Start has been called, just like the threads themselves started above.
+	go tp.dispatch()
+
 	return tp
 }
 
+func (t *Threadpool) threadAt(i int) *OSThread {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.threads[i]
+}
+
 func (t *Threadpool) start() {
-	defer func() {
-		close(t.stopped)
-	}()
+	defer close(t.stopped)
+
+	var wg sync.WaitGroup
+	for i := range t.threads {
+		wg.Add(1)
+		go t.superviseWorker(i, &wg)
+	}
 
 	// The t.stopping channel is never written so this blocks until the channel is
-	// closed at which point the threadpool is shutting down, so we want to stop
-	// each of the expected threads in it.
+	// closed at which point the threadpool is shutting down.
 	<-t.stopping
+	wg.Wait()
+}
+
+// superviseWorker keeps slot i of t.threads populated with a live OSThread until the pool is
+// stopping. If a worker's goroutine exits on its own - something recover() inside its loop
+// couldn't prevent - superviseWorker notices its done channel closed without t.stopping being
+// closed, and starts a replacement so the pool doesn't silently lose capacity.
+func (t *Threadpool) superviseWorker(i int, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		thread := t.threadAt(i)
+
+		select {
+		case <-t.stopping:
+			thread.Join()
+			return
+		case <-thread.done:
+			select {
+			case <-t.stopping:
+				return
+			default:
+			}
 
-	// Stop and wait for all threads, regardless if they are "in" the pool or being
-	// used to run caller code. The avoids race conditions where threads are removed
-	// and added back to the pool while we are trying to stop all of them.
-	for _, thread := range t.threads {
-		thread.Stop()
-		thread.Join()
+			replacement := NewOSThread(t.stopping, t.panics)
+			replacement.Start()
+
+			t.mu.Lock()
+			t.threads[i] = replacement
+			t.mu.Unlock()
+		}
 	}
 }
 
+// dispatch matches idle threads coming off t.pool with calls waiting in interactiveReq or
+// backgroundReq, always preferring an interactive waiter over a background one.
+func (t *Threadpool) dispatch() {
+	for {
+		select {
+		case <-t.stopping:
+			return
+		case idx := <-t.pool:
+			t.assign(idx)
+		}
+	}
+}
+
+// assign hands idx to the next waiting call, preferring PriorityInteractive over
+// PriorityBackground. If the pool is stopping before any call claims it, idx is left unassigned.
+func (t *Threadpool) assign(idx int) {
+	select {
+	case req := <-t.interactiveReq:
+		req.respond <- idx
+		return
+	default:
+	}
+
+	select {
+	case req := <-t.interactiveReq:
+		req.respond <- idx
+	case req := <-t.backgroundReq:
+		req.respond <- idx
+	case <-t.stopping:
+		t.pool <- idx
+	}
+}
+
+func (t *Threadpool) reqChanFor(p Priority) chan *threadRequest {
+	if p == PriorityInteractive {
+		return t.interactiveReq
+	}
+	return t.backgroundReq
+}
+
 func (t *Threadpool) Start() {
 	go t.start()
 }
@@ -101,25 +265,145 @@ func (t *Threadpool) StopAndWait() {
 	<-t.stopped
 }
 
-func (t *Threadpool) Call(fn func() (interface{}, error)) (interface{}, error) {
+// Call runs fn on a dedicated OS thread, passing it ctx so that it can poll for cancellation
+// (for example, between page faults or chunked reads). It is a wrapper around CallWithOptions
+// using PriorityBackground with an unbounded queue depth and wait, kept so existing callers can
+// keep working unchanged while they migrate to CallWithOptions at their own pace.
+func (t *Threadpool) Call(ctx context.Context, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	return t.CallWithOptions(ctx, fn, CallOptions{Priority: PriorityBackground})
+}
+
+// CallWithOptions runs fn on a dedicated OS thread, subject to opts. While waiting for a thread
+// to become available, it watches ctx: a caller whose context is done gives up its place in the
+// queue and returns ctx.Err() without disturbing any worker. If opts.MaxQueueDepth or opts.MaxWait
+// is exceeded instead, it returns ErrPoolOverloaded so the caller can shed load rather than block
+// indefinitely.
+func (t *Threadpool) CallWithOptions(ctx context.Context, fn func(context.Context) (interface{}, error), opts CallOptions) (interface{}, error) {
+	priority := opts.Priority
+	depth := &t.queueDepths[priority]
+	gauge := t.queueDepth.WithLabelValues(priority.String())
+
+	if !t.admitToQueue(depth, opts.MaxQueueDepth) {
+		t.rejected.WithLabelValues("queue_depth").Inc()
+		return nil, ErrPoolOverloaded
+	}
+
+	gauge.Inc()
+	// left tracks whether this call's queue slot has already been released, so that depth/gauge
+	// reflect calls actually waiting for a thread - not calls that have gone on to execute - while
+	// still releasing the slot exactly once regardless of which path below returns.
+	left := false
+	leaveQueue := func() {
+		if left {
+			return
+		}
+		left = true
+		atomic.AddInt64(depth, -1)
+		gauge.Dec()
+	}
+	defer leaveQueue()
+
+	waitCtx := ctx
+	if opts.MaxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, opts.MaxWait)
+		defer cancel()
+	}
+
 	start := time.Now()
+	req := &threadRequest{respond: make(chan int, 1)}
 
 	select {
+	case t.reqChanFor(priority) <- req:
+	case <-waitCtx.Done():
+		return nil, t.admissionError(ctx, "max_wait")
 	case <-t.stopping:
 		return nil, ErrPoolStopped
-	case thread := <-t.pool:
-		waiting := time.Since(start)
+	}
 
-		defer func() {
-			complete := time.Since(start)
+	// Past this point the dispatcher is committed to delivering an idx to req.respond as soon as
+	// one is free, no matter what this call does next, so it's always safe to hand draining it off
+	// to a goroutine if we give up below instead of waiting for it ourselves.
+	select {
+	case idx := <-req.respond:
+		// A thread has been handed to this call, so it's no longer waiting in the queue - release
+		// the slot now rather than once the whole call (including execution) finishes.
+		leaveQueue()
+		t.timing.WithLabelValues(labelWaiting, priority.String()).Observe(time.Since(start).Seconds())
+		return t.execute(ctx, idx, priority, fn)
+	case <-waitCtx.Done():
+		go t.returnWhenReady(req)
+		return nil, t.admissionError(ctx, "max_wait")
+	case <-t.stopping:
+		go t.returnWhenReady(req)
+		return nil, ErrPoolStopped
+	}
+}
+
+// admitToQueue atomically checks depth against maxDepth and, if there's room, increments depth
+// to claim a slot, via a CAS loop rather than a separate load-then-add so that concurrent callers
+// racing to admit themselves can't all observe room and together overshoot maxDepth. maxDepth <= 0
+// means unbounded, so the slot is always claimed.
+func (t *Threadpool) admitToQueue(depth *int64, maxDepth int) bool {
+	if maxDepth <= 0 {
+		atomic.AddInt64(depth, 1)
+		return true
+	}
+
+	for {
+		cur := atomic.LoadInt64(depth)
+		if cur >= int64(maxDepth) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(depth, cur, cur+1) {
+			return true
+		}
+	}
+}
+
+// returnWhenReady waits for the thread promised to req and returns it to the pool unused. It is
+// used when a call stops waiting after it has already been given a place in line, so the thread
+// the dispatcher assigns it isn't leaked.
+func (t *Threadpool) returnWhenReady(req *threadRequest) {
+	t.pool <- <-req.respond
+}
 
-			t.pool <- thread
-			t.tasks.Dec()
-			t.timing.WithLabelValues(labelWaiting).Observe(waiting.Seconds())
-			t.timing.WithLabelValues(labelComplete).Observe(complete.Seconds())
-		}()
+// admissionError decides what a call that stopped waiting should report: a context cancellation
+// it's genuinely responsible for, or ErrPoolOverloaded if it simply ran out of patience.
+func (t *Threadpool) admissionError(ctx context.Context, reason string) error {
+	if err := ctx.Err(); err != nil {
+		t.cancelled.WithLabelValues(err.Error()).Inc()
+		return err
+	}
+	t.rejected.WithLabelValues(reason).Inc()
+	return ErrPoolOverloaded
+}
+
+func (t *Threadpool) execute(ctx context.Context, idx int, priority Priority, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	defer func() {
+		t.pool <- idx
+		t.tasks.Dec()
+	}()
 
-		t.tasks.Inc()
-		return thread.Call(fn)
+	t.tasks.Inc()
+	executingStart := time.Now()
+	res, err := t.threadAt(idx).Call(func() (interface{}, error) {
+		return fn(ctx)
+	})
+	t.timing.WithLabelValues(labelExecuting, priority.String()).Observe(time.Since(executingStart).Seconds())
+
+	if err == nil && ctx.Err() != nil {
+		t.cancelled.WithLabelValues(ctx.Err().Error()).Inc()
 	}
+
+	return res, err
+}
+
+// CallBackground is a thin wrapper around Call for callers that haven't yet been migrated to
+// thread a context through. It runs fn with context.Background(), so it behaves exactly like
+// the previous, context-less Call.
+func (t *Threadpool) CallBackground(fn func() (interface{}, error)) (interface{}, error) {
+	return t.Call(context.Background(), func(context.Context) (interface{}, error) {
+		return fn()
+	})
 }